@@ -0,0 +1,62 @@
+// Package handlers_examples provides reference sftp.LinkHandler
+// implementations for sftp.RequestServer: an in-memory one useful for tests,
+// and an os-backed one that works against the local filesystem.
+package handlers_examples
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OsLinkHandler implements sftp.LinkHandler directly against the local
+// filesystem, with Realpath resolutions confined to Root.
+type OsLinkHandler struct {
+	// Root anchors relative paths passed to Realpath and bounds what Realpath
+	// will resolve to; Readlink, Symlink and Hardlink use their paths as
+	// given. The zero value is the filesystem root.
+	Root string
+}
+
+func (OsLinkHandler) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+func (OsLinkHandler) Symlink(oldpath, newpath string) error {
+	return os.Symlink(oldpath, newpath)
+}
+
+func (OsLinkHandler) Hardlink(oldpath, newpath string) error {
+	return os.Link(oldpath, newpath)
+}
+
+func (h OsLinkHandler) Realpath(path string) (string, error) {
+	root := h.Root
+	if root == "" {
+		root = "/"
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		// REALPATH routinely gets asked about a not-yet-existing target
+		// (e.g. an upload destination), and OpenSSH's realpath tolerates a
+		// missing final component. Resolve the parent instead and
+		// re-append the leaf; fall back to a plain Clean if even the
+		// parent doesn't exist.
+		if dir, dirErr := filepath.EvalSymlinks(filepath.Dir(path)); dirErr == nil {
+			resolved = filepath.Join(dir, filepath.Base(path))
+		} else {
+			resolved = filepath.Clean(path)
+		}
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("realpath: %s escapes root %s", path, root)
+	}
+	return resolved, nil
+}
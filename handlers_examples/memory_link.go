@@ -0,0 +1,56 @@
+package handlers_examples
+
+import (
+	"fmt"
+	"path"
+	"sync"
+)
+
+// MemLinkHandler implements sftp.LinkHandler against an in-memory table of
+// symlinks and hardlinks, for use in tests that don't want to touch disk.
+type MemLinkHandler struct {
+	mu        sync.Mutex
+	symlinks  map[string]string // newpath -> oldpath
+	hardlinks map[string]string // newpath -> oldpath
+}
+
+func NewMemLinkHandler() *MemLinkHandler {
+	return &MemLinkHandler{
+		symlinks:  make(map[string]string),
+		hardlinks: make(map[string]string),
+	}
+}
+
+func (m *MemLinkHandler) Readlink(p string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	target, ok := m.symlinks[p]
+	if !ok {
+		return "", fmt.Errorf("readlink %s: not a symlink", p)
+	}
+	return target, nil
+}
+
+func (m *MemLinkHandler) Symlink(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.symlinks[newpath] = oldpath
+	return nil
+}
+
+func (m *MemLinkHandler) Hardlink(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hardlinks[newpath] = oldpath
+	return nil
+}
+
+// Realpath just cleans p against an implicit "/" root; unlike
+// OsLinkHandler, it does no root confinement (there's no real filesystem to
+// escape), so don't assume parity between the two here.
+func (m *MemLinkHandler) Realpath(p string) (string, error) {
+	if path.IsAbs(p) {
+		return path.Clean(p), nil
+	}
+	return path.Clean("/" + p), nil
+}
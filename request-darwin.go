@@ -0,0 +1,54 @@
+//go:build darwin
+// +build darwin
+
+package sftp
+
+import "syscall"
+
+// DefaultStatVFS is the StatVFSer used when a consumer just wants real
+// filesystem-stat semantics without writing their own. Setting
+// Handlers.StatVFS = DefaultStatVFS{} is enough on its own: RequestServer
+// advertises statvfs@openssh.com/fstatvfs@openssh.com to the client as soon
+// as Handlers.StatVFS is non-nil.
+type DefaultStatVFS struct{}
+
+func (DefaultStatVFS) StatVFS(r *Request) (*StatVFS, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(r.Filepath, &stat); err != nil {
+		return nil, err
+	}
+	return &StatVFS{
+		Bsize:   uint64(stat.Bsize),
+		Frsize:  uint64(stat.Bsize),
+		Blocks:  stat.Blocks,
+		Bfree:   stat.Bfree,
+		Bavail:  stat.Bavail,
+		Files:   stat.Files,
+		Ffree:   stat.Ffree,
+		Favail:  stat.Ffree,
+		Fsid:    uint64(stat.Fsid.Val[0]),
+		Flag:    statvfsFlags(int64(stat.Flags)),
+		Namemax: 1024,
+	}, nil
+}
+
+// statvfsFlags remaps Darwin's MNT_* mount flags onto the statvfs@openssh.com
+// wire flags explicitly: their bit positions don't match (e.g. MNT_NOSUID is
+// 0x8 here but 0x2 on the wire), so passing stat.Flags through as-is would
+// send the wrong bits to the client.
+func statvfsFlags(raw int64) uint64 {
+	// MNT_RDONLY and MNT_NOSUID from <sys/mount.h>; the syscall package
+	// doesn't export them for darwin.
+	const (
+		mntRdonly = 0x1
+		mntNosuid = 0x8
+	)
+	var flag uint64
+	if raw&mntRdonly != 0 {
+		flag |= sshStatVFSFlagReadonly
+	}
+	if raw&mntNosuid != 0 {
+		flag |= sshStatVFSFlagNoSuid
+	}
+	return flag
+}
@@ -0,0 +1,30 @@
+package sftp
+
+import "os"
+
+// ListerAt is returned by FileInfoer.Filelist for SSH_FXP_OPENDIR/READDIR. It
+// mirrors io.ReaderAt but for directory entries, so a Handlers
+// implementation can page through a listing (e.g. from a DB cursor) rather
+// than holding the whole directory in memory.
+//
+// ListAt copies entries starting at offset into ls, returning the number
+// copied. It returns io.EOF once offset is at or past the end of the
+// listing.
+type ListerAt interface {
+	ListAt([]os.FileInfo, int64) (int, error)
+}
+
+// LinkHandler is an optional Handlers field that lets a RequestServer answer
+// SSH_FXP_READLINK, SSH_FXP_SYMLINK, SSH_FXP_REALPATH, and the
+// hardlink@openssh.com extension. Consumers that don't set Handlers.Link
+// get SSH_FX_OP_UNSUPPORTED for all four.
+type LinkHandler interface {
+	// Readlink returns the target of the symlink at path.
+	Readlink(path string) (string, error)
+	// Symlink creates newpath as a symlink pointing at oldpath.
+	Symlink(oldpath, newpath string) error
+	// Hardlink creates newpath as a hard link to oldpath.
+	Hardlink(oldpath, newpath string) error
+	// Realpath resolves path to a canonical, absolute path.
+	Realpath(path string) (string, error)
+}
@@ -1,11 +1,17 @@
 package sftp
 
 import (
+	"crypto/rand"
 	"encoding"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 )
 
 // Server takes the dataHandler and openHandler as arguments
@@ -30,23 +36,204 @@ import (
 
 var maxTxPacket uint32 = 1 << 15
 
+// clamp caps requested to max, so a client asking for an oversized read
+// can't make us allocate an unbounded buffer.
+func clamp(requested, max uint32) uint32 {
+	if requested > max {
+		return max
+	}
+	return requested
+}
+
+// sftpProtocolVersionMax is the highest protocol version this package knows
+// how to speak. RequestServer.MaxVersion defaults to sftpProtocolVersion (3)
+// for backwards compatibility with older clients, but can be raised up to
+// this value.
+const sftpProtocolVersionMax = 6
+
+// serverExtensions lists the extended requests this server knows how to
+// advertise during version negotiation. Whether one actually gets
+// advertised is decided per-extension by extensionAdvertised: statvfs,
+// fstatvfs, and hardlink are serviced straight off Handlers.StatVFS /
+// Handlers.Link and advertised whenever those are set, while anything else
+// here falls back to whether it has an entry in Handlers.Extensions.
+var serverExtensions = []extensionPair{
+	{"statvfs@openssh.com", "2"},
+	{"fstatvfs@openssh.com", "2"},
+	{"posix-rename@openssh.com", "1"},
+	{"hardlink@openssh.com", "1"},
+}
+
 type handleHandler func(string) string
 
+// maxInFlightPerHandle bounds how many Read/Write packets we'll service
+// concurrently for a single open handle, so a client that pipelines
+// aggressively can't unbound the number of outstanding goroutines/buffers.
+const maxInFlightPerHandle = 64
+
+// defaultMaxOpenHandles matches OpenSSH's sftp-server default, and bounds how
+// many handles (open files plus open directories) a single session may hold
+// at once.
+const defaultMaxOpenHandles = 256
+
+// Close is called by RequestServer once, when the handle backed by this
+// Request is closed, swept for being idle, or fails to register. It does
+// nothing and always returns nil; Handlers implementations have no way to
+// hook into it. A reader or writer from FileGet/FilePut that implements
+// io.Closer is closed separately by the handle.
+func (r *Request) Close() error {
+	return nil
+}
+
+// fileHandle is what a handle string resolves to once a file has been
+// opened: the underlying Request plus the io.ReaderAt/io.WriterAt obtained
+// from Handlers at open time, and a semaphore bounding in-flight Read/Write
+// packets against it.
+type fileHandle struct {
+	request  *Request
+	reader   io.ReaderAt
+	writer   io.WriterAt
+	sem      chan struct{}
+	wg       sync.WaitGroup // tracks in-flight Read/Write goroutines against this handle
+	lastUsed int64          // unix nanos, accessed atomically
+}
+
+func (fh *fileHandle) touch() {
+	atomic.StoreInt64(&fh.lastUsed, time.Now().UnixNano())
+}
+
+func (fh *fileHandle) idleSince() int64 {
+	return atomic.LoadInt64(&fh.lastUsed)
+}
+
+// close releases whatever resources this handle accumulated: the
+// reader/writer obtained from Handlers at Open time (if they also implement
+// io.Closer), and the backing Request itself.
+//
+// It first waits for any Read/Write goroutine already in flight against this
+// handle to finish, so it can't touch the reader/writer after they're
+// closed, and can't reply after the Close ack that's about to go out.
+func (fh *fileHandle) close() {
+	fh.wg.Wait()
+	if c, ok := fh.reader.(io.Closer); ok {
+		c.Close()
+	}
+	if c, ok := fh.writer.(io.Closer); ok {
+		c.Close()
+	}
+	fh.request.Close()
+}
+
+// maxReaddirEntries bounds how many directory entries a single READDIR
+// reply carries; the client keeps calling READDIR until it sees EOF.
+const maxReaddirEntries = 100
+
+// dirHandle is what an Opendir handle resolves to: a snapshot of the
+// os.FileInfo entries Handlers.FileInfo produced at Opendir time, plus a
+// cursor into it. Like a fileHandle, it's never keyed by path, so two
+// clients opening the same directory get independent cursors, and a
+// Readdir never has to go back to Handlers.
+type dirHandle struct {
+	request  *Request
+	entries  []os.FileInfo
+	cursor   int
+	mu       sync.Mutex // guards cursor, since two Readdirs can race on one handle
+	lastUsed int64      // unix nanos, accessed atomically
+}
+
+func (dh *dirHandle) touch() {
+	atomic.StoreInt64(&dh.lastUsed, time.Now().UnixNano())
+}
+
+func (dh *dirHandle) idleSince() int64 {
+	return atomic.LoadInt64(&dh.lastUsed)
+}
+
+// close releases the backing Request, mirroring fileHandle.close so a
+// directory handle doesn't leak whatever Request.Close cleans up.
+func (dh *dirHandle) close() {
+	dh.request.Close()
+}
+
+// next returns up to maxReaddirEntries entries starting at the cursor and
+// advances it, or io.EOF once the snapshot is exhausted.
+func (dh *dirHandle) next() ([]os.FileInfo, error) {
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+	if dh.cursor >= len(dh.entries) {
+		return nil, io.EOF
+	}
+	end := dh.cursor + maxReaddirEntries
+	if end > len(dh.entries) {
+		end = len(dh.entries)
+	}
+	batch := dh.entries[dh.cursor:end]
+	dh.cursor = end
+	return batch, nil
+}
+
+// ExtensionHandler handles a single SSH_FXP_EXTENDED request. It receives the
+// already-unmarshaled request id and the raw extension-specific payload, and
+// replies with whatever packet the extension's reply format requires.
+type ExtensionHandler func(rs *RequestServer, id uint32, data []byte) (encoding.BinaryMarshaler, error)
+
 type Handlers struct {
 	FileGet  FileReader
 	FilePut  FileWriter
 	FileCmd  FileCmder
 	FileInfo FileInfoer
+
+	// Link optionally answers SSH_FXP_READLINK, SSH_FXP_SYMLINK,
+	// SSH_FXP_REALPATH, and the hardlink@openssh.com extension. Left nil,
+	// all four reply with SSH_FX_OP_UNSUPPORTED.
+	Link LinkHandler
+
+	// StatVFS optionally answers statvfs@openssh.com and
+	// fstatvfs@openssh.com, both of which are advertised to the client
+	// automatically once this is set. Left nil, both reply with
+	// SSH_FX_OP_UNSUPPORTED and neither is advertised.
+	StatVFS StatVFSer
+
+	// Extensions maps an extended request name to the handler that services
+	// it, for extensions with no dedicated Handlers field (e.g.
+	// "posix-rename@openssh.com"). statvfs@openssh.com, fstatvfs@openssh.com,
+	// and hardlink@openssh.com are serviced via StatVFS/Link instead and
+	// don't need an entry here. Names with no entry here, and no dedicated
+	// field set, are not advertised to the client during version
+	// negotiation.
+	Extensions map[string]ExtensionHandler
 }
 
 // Server that abstracts the sftp protocol for a http request-like protocol
 type RequestServer struct {
 	serverConn
-	Handlers        Handlers
-	debugStream     io.Writer
-	pktChan         chan packet
-	openRequests    map[string]*Request
+	Handlers    Handlers
+	debugStream io.Writer
+	pktChan     chan packet
+
+	// MaxVersion is the highest SFTP protocol version this server will
+	// negotiate with a client. It defaults to sftpProtocolVersion (3) for
+	// compatibility; set it up to sftpProtocolVersionMax to opt into v4-v6
+	// behavior and extensions.
+	MaxVersion uint32
+
+	// MaxOpenHandles caps how many handles (files plus directories) this
+	// session may have open at once. 0 disables the limit. Defaults to
+	// defaultMaxOpenHandles.
+	MaxOpenHandles int
+
+	// IdleTimeout, if positive, closes handles that haven't been touched in
+	// that long; opening a handle and every request made against it count
+	// as a touch. 0 (the default) disables the sweeper.
+	IdleTimeout time.Duration
+
+	openRequests    map[string]*fileHandle
 	openRequestLock sync.RWMutex
+
+	openDirs    map[string]*dirHandle
+	openDirLock sync.RWMutex
+
+	openHandleCount int32 // accessed atomically; files + dirs currently open
 }
 
 // simple factory function
@@ -59,38 +246,322 @@ func NewRequestServer(rwc io.ReadWriteCloser) (*RequestServer, error) {
 				WriteCloser: rwc,
 			},
 		},
-		debugStream:  ioutil.Discard,
-		pktChan:      make(chan packet, sftpServerWorkerCount),
-		openRequests: make(map[string]*Request),
+		debugStream:    ioutil.Discard,
+		pktChan:        make(chan packet, sftpServerWorkerCount),
+		MaxVersion:     sftpProtocolVersion,
+		MaxOpenHandles: defaultMaxOpenHandles,
+		openRequests:   make(map[string]*fileHandle),
+		openDirs:       make(map[string]*dirHandle),
 	}
 
 	return s, nil
 }
 
-func (rs *RequestServer) nextRequest(r *Request) string {
+// negotiatedVersion returns the protocol version to advertise back to the
+// client: the lower of what the client asked for and what this server
+// supports.
+func (rs *RequestServer) negotiatedVersion(clientVersion uint32) uint32 {
+	max := rs.MaxVersion
+	if max == 0 || max > sftpProtocolVersionMax {
+		max = sftpProtocolVersion
+	}
+	if clientVersion < max {
+		return clientVersion
+	}
+	return max
+}
+
+// extensionAdvertised reports whether name should be advertised in the
+// version reply. statvfs@openssh.com, fstatvfs@openssh.com, and
+// hardlink@openssh.com are serviced directly off Handlers.StatVFS /
+// Handlers.Link (see the special-cases in packetWorker's
+// *sshFxpExtendedPacket branch), bypassing Handlers.Extensions entirely, so
+// they're gated on those fields being set rather than on the map. Anything
+// else is gated on having an entry in Handlers.Extensions.
+func (rs *RequestServer) extensionAdvertised(name string) bool {
+	switch name {
+	case "statvfs@openssh.com", "fstatvfs@openssh.com":
+		return rs.Handlers.StatVFS != nil
+	case "hardlink@openssh.com":
+		return rs.Handlers.Link != nil
+	default:
+		_, ok := rs.Handlers.Extensions[name]
+		return ok
+	}
+}
+
+// advertisedExtensions returns the extension pairs to include in the version
+// reply: only those the consumer actually wired up a handler for.
+func (rs *RequestServer) advertisedExtensions() []extensionPair {
+	var exts []extensionPair
+	for _, ext := range serverExtensions {
+		if rs.extensionAdvertised(ext.Name) {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// namePacketFor wraps a single resolved path in the SSH_FXP_NAME reply that
+// READLINK and REALPATH use.
+func namePacketFor(id uint32, name string) sshFxpNamePacket {
+	return sshFxpNamePacket{
+		ID: id,
+		NameAttrs: []sshFxpNameAttr{
+			{Name: name, LongName: name, Attrs: emptyFileStat},
+		},
+	}
+}
+
+// handleHardlink services the hardlink@openssh.com extension, which isn't
+// routed through Handlers.Extensions since it's answered by the LinkHandler
+// like the other SSH_FXP_* link operations.
+func (rs *RequestServer) handleHardlink(pkt *sshFxpExtendedPacket) encoding.BinaryMarshaler {
+	if rs.Handlers.Link == nil {
+		return statusFromError(pkt, syscall.EOPNOTSUPP)
+	}
+	oldpath, rest := unmarshalString(pkt.SpecificData)
+	newpath, _ := unmarshalString(rest)
+	return statusFromError(pkt, rs.Handlers.Link.Hardlink(oldpath, newpath))
+}
+
+// handleStatVFS services statvfs@openssh.com (a path) and
+// fstatvfs@openssh.com (an already-open handle).
+func (rs *RequestServer) handleStatVFS(pkt *sshFxpExtendedPacket) encoding.BinaryMarshaler {
+	if rs.Handlers.StatVFS == nil {
+		return statusFromError(pkt, syscall.EOPNOTSUPP)
+	}
+
+	target, _ := unmarshalString(pkt.SpecificData)
+	filepath := target
+	if pkt.ExtendedRequest == "fstatvfs@openssh.com" {
+		req, ok := rs.getRequest(target)
+		if !ok {
+			return statusFromError(pkt, syscall.EBADF)
+		}
+		filepath = req.Filepath
+	}
+
+	vfs, err := rs.Handlers.StatVFS.StatVFS(newRequest(filepath))
+	if err != nil {
+		return statusFromError(pkt, err)
+	}
+	data, _ := vfs.MarshalBinary()
+	return sshFxpExtendedReplyPacket{ID: pkt.id(), Data: data}
+}
+
+// newHandleID returns an unguessable handle string, used for file and
+// directory handles so two clients opening the same path don't collide on it.
+func newHandleID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand should never fail
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// reserveHandleSlot admits one more handle against MaxOpenHandles, or
+// refuses with a descriptive error if the session is already at its limit.
+func (rs *RequestServer) reserveHandleSlot() error {
+	n := atomic.AddInt32(&rs.openHandleCount, 1)
+	if rs.MaxOpenHandles > 0 && int(n) > rs.MaxOpenHandles {
+		atomic.AddInt32(&rs.openHandleCount, -1)
+		return fmt.Errorf("sftp: too many open handles (limit %d)", rs.MaxOpenHandles)
+	}
+	return nil
+}
+
+func (rs *RequestServer) releaseHandleSlot() {
+	atomic.AddInt32(&rs.openHandleCount, -1)
+}
+
+// nextDirHandle registers a dirHandle under a fresh random handle string,
+// subject to MaxOpenHandles.
+func (rs *RequestServer) nextDirHandle(dh *dirHandle) (string, error) {
+	if err := rs.reserveHandleSlot(); err != nil {
+		return "", err
+	}
+	dh.touch()
+	handle := newHandleID()
+	rs.openDirLock.Lock()
+	rs.openDirs[handle] = dh
+	rs.openDirLock.Unlock()
+	return handle, nil
+}
+
+func (rs *RequestServer) getDirHandle(handle string) (*dirHandle, bool) {
+	rs.openDirLock.RLock()
+	defer rs.openDirLock.RUnlock()
+	dh, ok := rs.openDirs[handle]
+	return dh, ok
+}
+
+func (rs *RequestServer) closeDirHandle(handle string) bool {
+	rs.openDirLock.Lock()
+	dh, ok := rs.openDirs[handle]
+	delete(rs.openDirs, handle)
+	rs.openDirLock.Unlock()
+	if ok {
+		dh.close()
+		rs.releaseHandleSlot()
+	}
+	return ok
+}
+
+// closeIdleHandles evicts any file or directory handle untouched for longer
+// than IdleTimeout. No-op when IdleTimeout is 0.
+func (rs *RequestServer) closeIdleHandles() {
+	if rs.IdleTimeout <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-rs.IdleTimeout).UnixNano()
+
+	var stale []*fileHandle
 	rs.openRequestLock.Lock()
-	defer rs.openRequestLock.Unlock()
-	rs.openRequests[r.Filepath] = r
-	return r.Filepath
+	for handle, fh := range rs.openRequests {
+		if fh.idleSince() < cutoff {
+			delete(rs.openRequests, handle)
+			stale = append(stale, fh)
+		}
+	}
+	rs.openRequestLock.Unlock()
+	for _, fh := range stale {
+		fh.close()
+		rs.releaseHandleSlot()
+	}
+
+	var staleDirs []*dirHandle
+	rs.openDirLock.Lock()
+	for handle, dh := range rs.openDirs {
+		if dh.idleSince() < cutoff {
+			delete(rs.openDirs, handle)
+			staleDirs = append(staleDirs, dh)
+		}
+	}
+	rs.openDirLock.Unlock()
+	for _, dh := range staleDirs {
+		dh.close()
+		rs.releaseHandleSlot()
+	}
+}
+
+// idleSweeper runs closeIdleHandles on a cadence until done is closed.
+func (rs *RequestServer) idleSweeper(done <-chan struct{}) {
+	if rs.IdleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(rs.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			rs.closeIdleHandles()
+		}
+	}
+}
+
+// snapshotListerAt drains lister fully into a slice, by calling ListAt in
+// batches until it reports io.EOF. Opendir does this once up front so the
+// resulting dirHandle can page through a fixed snapshot purely with an
+// integer cursor, without going back to Handlers (and without exposing
+// lister, which isn't safe for the concurrent Readdirs a handle can see).
+func snapshotListerAt(lister ListerAt) ([]os.FileInfo, error) {
+	var all []os.FileInfo
+	buf := make([]os.FileInfo, maxReaddirEntries)
+	for {
+		n, err := lister.ListAt(buf, int64(len(all)))
+		all = append(all, buf[:n]...)
+		if err != nil {
+			if err == io.EOF {
+				return all, nil
+			}
+			return nil, err
+		}
+		if n == 0 {
+			return all, nil
+		}
+	}
+}
+
+// direntPacket builds the SSH_FXP_NAME reply a READDIR call replies with.
+func direntPacket(id uint32, dirname string, infos []os.FileInfo) sshFxpNamePacket {
+	nameAttrs := make([]sshFxpNameAttr, len(infos))
+	for i, fi := range infos {
+		nameAttrs[i] = sshFxpNameAttr{
+			Name:     fi.Name(),
+			LongName: runLs(dirname, fi),
+			Attrs:    fileInfoToAttrs(fi),
+		}
+	}
+	return sshFxpNamePacket{ID: id, NameAttrs: nameAttrs}
+}
+
+// nextHandle registers a fileHandle (backed by an open file's reader/writer)
+// under a fresh random handle string, subject to MaxOpenHandles.
+func (rs *RequestServer) nextHandle(fh *fileHandle) (string, error) {
+	if err := rs.reserveHandleSlot(); err != nil {
+		return "", err
+	}
+	fh.touch()
+	handle := newHandleID()
+	rs.openRequestLock.Lock()
+	rs.openRequests[handle] = fh
+	rs.openRequestLock.Unlock()
+	return handle, nil
 }
 
 func (rs *RequestServer) getRequest(handle string) (*Request, bool) {
+	fh, ok := rs.getHandle(handle)
+	if !ok {
+		return nil, false
+	}
+	return fh.request, true
+}
+
+func (rs *RequestServer) getHandle(handle string) (*fileHandle, bool) {
 	rs.openRequestLock.Lock()
 	defer rs.openRequestLock.Unlock()
-	r, ok := rs.openRequests[handle]
-	return r, ok
+	fh, ok := rs.openRequests[handle]
+	return fh, ok
 }
 
-func (rs *RequestServer) closeRequest(handle string) {
+// acquireHandle looks fh up and registers one in-flight Read/Write goroutine
+// against it, atomically with respect to closeRequest/closeIdleHandles
+// deleting it from openRequests. Doing the lookup and fh.wg.Add(1) under the
+// same lock that guards the delete closes the window a plain getHandle
+// followed by a separate wg.Add(1) leaves open: without it, a Close
+// processed in between could see a zero counter, close the handle, and
+// race with the goroutine this call is about to spawn.
+func (rs *RequestServer) acquireHandle(handle string) (*fileHandle, bool) {
 	rs.openRequestLock.Lock()
 	defer rs.openRequestLock.Unlock()
-	if _, ok := rs.openRequests[handle]; ok {
-		delete(rs.openRequests, handle)
+	fh, ok := rs.openRequests[handle]
+	if !ok {
+		return nil, false
+	}
+	fh.wg.Add(1)
+	return fh, true
+}
+
+func (rs *RequestServer) closeRequest(handle string) {
+	rs.openRequestLock.Lock()
+	fh, ok := rs.openRequests[handle]
+	delete(rs.openRequests, handle)
+	rs.openRequestLock.Unlock()
+	if ok {
+		fh.close()
+		rs.releaseHandleSlot()
 	}
 }
 
 // start serving requests from user session
 func (rs *RequestServer) Serve() error {
+	sweeperDone := make(chan struct{})
+	go rs.idleSweeper(sweeperDone)
+	defer close(sweeperDone)
+
 	var wg sync.WaitGroup
 	wg.Add(sftpServerWorkerCount)
 	for i := 0; i < sftpServerWorkerCount; i++ {
@@ -121,44 +592,211 @@ func (rs *RequestServer) Serve() error {
 func (rs *RequestServer) packetWorker() error {
 	for pkt := range rs.pktChan {
 		// handle packet specific pre-processing
-		var handle string
+		var request *Request
 		var rpkt encoding.BinaryMarshaler
 		var err error
 		switch pkt := pkt.(type) {
 		case *sshFxInitPacket:
-			err := rs.sendPacket(sshFxVersionPacket{sftpProtocolVersion, nil})
+			version := rs.negotiatedVersion(pkt.Version)
+			err := rs.sendPacket(sshFxVersionPacket{version, rs.advertisedExtensions()})
 			if err != nil { return err }
 			continue
+		case *sshFxpExtendedPacket:
+			if pkt.ExtendedRequest == "hardlink@openssh.com" {
+				rpkt := rs.handleHardlink(pkt)
+				if err := rs.sendPacket(rpkt); err != nil { return err }
+				continue
+			}
+			if pkt.ExtendedRequest == "statvfs@openssh.com" || pkt.ExtendedRequest == "fstatvfs@openssh.com" {
+				rpkt := rs.handleStatVFS(pkt)
+				if err := rs.sendPacket(rpkt); err != nil { return err }
+				continue
+			}
+			handler, ok := rs.Handlers.Extensions[pkt.ExtendedRequest]
+			if !ok {
+				err := rs.sendPacket(statusFromError(pkt, syscall.EOPNOTSUPP))
+				if err != nil { return err }
+				continue
+			}
+			rpkt, err := handler(rs, pkt.id(), pkt.SpecificData)
+			if err != nil {
+				rpkt = statusFromError(pkt, err)
+			}
+			if err := rs.sendPacket(rpkt); err != nil { return err }
+			continue
+		case *sshFxpReadlinkPacket:
+			var rpkt encoding.BinaryMarshaler
+			if rs.Handlers.Link == nil {
+				rpkt = statusFromError(pkt, syscall.EOPNOTSUPP)
+			} else if target, err := rs.Handlers.Link.Readlink(pkt.getPath()); err != nil {
+				rpkt = statusFromError(pkt, err)
+			} else {
+				rpkt = namePacketFor(pkt.id(), target)
+			}
+			if err := rs.sendPacket(rpkt); err != nil { return err }
+			continue
+		case *sshFxpSymlinkPacket:
+			var rpkt encoding.BinaryMarshaler
+			if rs.Handlers.Link == nil {
+				rpkt = statusFromError(pkt, syscall.EOPNOTSUPP)
+			} else {
+				rpkt = statusFromError(pkt, rs.Handlers.Link.Symlink(pkt.Targetpath, pkt.Linkpath))
+			}
+			if err := rs.sendPacket(rpkt); err != nil { return err }
+			continue
+		case *sshFxpRealpathPacket:
+			var rpkt encoding.BinaryMarshaler
+			if rs.Handlers.Link == nil {
+				rpkt = statusFromError(pkt, syscall.EOPNOTSUPP)
+			} else if resolved, err := rs.Handlers.Link.Realpath(pkt.getPath()); err != nil {
+				rpkt = statusFromError(pkt, err)
+			} else {
+				rpkt = namePacketFor(pkt.id(), resolved)
+			}
+			if err := rs.sendPacket(rpkt); err != nil { return err }
+			continue
 		case *sshFxpOpenPacket:
-			handle = rs.nextRequest(newRequest(pkt.getPath()))
-			err := rs.sendPacket(sshFxpHandlePacket{pkt.id(), handle})
-			if err != nil { return err }
+			req := newRequest(pkt.getPath())
+			req.populate(pkt)
+			fh := &fileHandle{request: req, sem: make(chan struct{}, maxInFlightPerHandle)}
+			if pkt.Pflags&sshFxfRead != 0 {
+				reader, err := rs.Handlers.FileGet.Fileread(req)
+				if err != nil {
+					if err := rs.sendPacket(statusFromError(pkt, err)); err != nil { return err }
+					continue
+				}
+				fh.reader = reader
+			}
+			if pkt.Pflags&sshFxfWrite != 0 {
+				writer, err := rs.Handlers.FilePut.Filewrite(req)
+				if err != nil {
+					if err := rs.sendPacket(statusFromError(pkt, err)); err != nil { return err }
+					continue
+				}
+				fh.writer = writer
+			}
+			handle, err := rs.nextHandle(fh)
+			if err != nil {
+				// Fileread/Filewrite already opened the reader/writer above;
+				// nextHandle only failed on reserveHandleSlot, so nothing
+				// else will ever close them unless we do it here.
+				fh.close()
+				if err := rs.sendPacket(statusFromError(pkt, err)); err != nil { return err }
+				continue
+			}
+			if err := rs.sendPacket(sshFxpHandlePacket{pkt.id(), handle}); err != nil { return err }
+			continue
+		case *sshFxpReadPacket, *sshFxpWritePacket:
+			handle := pkt.(hasHandle).getHandle()
+			fh, ok := rs.acquireHandle(handle)
+			if !ok {
+				if err := rs.sendPacket(statusFromError(pkt, syscall.EBADF)); err != nil { return err }
+				continue
+			}
+			fh.touch()
+			fh.sem <- struct{}{}
+			go func(pkt packet, fh *fileHandle) {
+				defer fh.wg.Done()
+				defer func() { <-fh.sem }()
+
+				var rpkt encoding.BinaryMarshaler
+				switch p := pkt.(type) {
+				case *sshFxpReadPacket:
+					if fh.reader == nil {
+						rpkt = statusFromError(p, syscall.EBADF)
+						break
+					}
+					data := make([]byte, clamp(p.Len, maxTxPacket))
+					n, err := fh.reader.ReadAt(data, int64(p.Offset))
+					if err != nil && (err != io.EOF || n == 0) {
+						rpkt = statusFromError(p, err)
+					} else {
+						rpkt = sshFxpDataPacket{p.id(), data[:n]}
+					}
+				case *sshFxpWritePacket:
+					if fh.writer == nil {
+						rpkt = statusFromError(p, syscall.EBADF)
+						break
+					}
+					_, err := fh.writer.WriteAt(p.Data, int64(p.Offset))
+					rpkt = statusFromError(p, err)
+				}
+
+				if err := rs.sendPacket(rpkt); err != nil {
+					rs.conn.Close()
+				}
+			}(pkt, fh)
 			continue
 		case *sshFxpOpendirPacket:
-			handle = rs.nextRequest(newRequest(pkt.getPath()))
-			err := rs.sendPacket(sshFxpHandlePacket{pkt.id(), handle})
-			if err != nil { return err }
+			req := newRequest(pkt.getPath())
+			req.populate(pkt)
+			lister, err := rs.Handlers.FileInfo.Filelist(req)
+			if err != nil {
+				if err := rs.sendPacket(statusFromError(pkt, err)); err != nil { return err }
+				continue
+			}
+			entries, err := snapshotListerAt(lister)
+			if err != nil {
+				if err := rs.sendPacket(statusFromError(pkt, err)); err != nil { return err }
+				continue
+			}
+			handle, err := rs.nextDirHandle(&dirHandle{request: req, entries: entries})
+			if err != nil {
+				if err := rs.sendPacket(statusFromError(pkt, err)); err != nil { return err }
+				continue
+			}
+			if err := rs.sendPacket(sshFxpHandlePacket{pkt.id(), handle}); err != nil { return err }
+			continue
+		case *sshFxpReaddirPacket:
+			dh, ok := rs.getDirHandle(pkt.getHandle())
+			if !ok {
+				if err := rs.sendPacket(statusFromError(pkt, syscall.EBADF)); err != nil { return err }
+				continue
+			}
+			dh.touch()
+			batch, lerr := dh.next()
+
+			var rpkt encoding.BinaryMarshaler
+			switch {
+			case lerr == io.EOF:
+				rpkt = statusFromError(pkt, io.EOF)
+			case lerr != nil:
+				rpkt = statusFromError(pkt, lerr)
+			default:
+				rpkt = direntPacket(pkt.id(), dh.request.Filepath, batch)
+			}
+			if err := rs.sendPacket(rpkt); err != nil { return err }
 			continue
 		case *sshFxpClosePacket:
-			handle = pkt.getHandle()
-			rs.closeRequest(handle)
+			handle := pkt.getHandle()
+			if !rs.closeDirHandle(handle) {
+				rs.closeRequest(handle)
+			}
 			err := rs.sendError(pkt, nil)
 			if err != nil { return err }
 			continue
 		case hasHandle:
-			handle = pkt.getHandle()
+			fh, ok := rs.getHandle(pkt.getHandle())
+			if !ok {
+				rpkt = statusFromError(pkt, syscall.EBADF)
+				break
+			}
+			fh.touch()
+			request = fh.request
 		case hasPath:
-			handle = rs.nextRequest(newRequest(pkt.getPath()))
+			// One-shot path ops (Stat, Remove, Rename, ...) aren't handles
+			// the client will ever reference again, so they don't go
+			// through the bounded handle table at all.
+			request = newRequest(pkt.getPath())
 		}
 
-		request, ok := rs.getRequest(handle)
-		if !ok { rpkt = statusFromError(pkt, syscall.EBADF) }
-		request.populate(pkt)
-		rpkt, err = request.handleRequest(rs.Handlers)
-		if err != nil { rpkt = statusFromError(pkt, err) }
+		if request != nil {
+			request.populate(pkt)
+			rpkt, err = request.handleRequest(rs.Handlers)
+			if err != nil { rpkt = statusFromError(pkt, err) }
+		}
 
-		err = rs.sendPacket(rpkt)
-		if err != nil { return err }
+		if err := rs.sendPacket(rpkt); err != nil { return err }
 	}
 	return nil
 }
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package sftp
+
+import "syscall"
+
+// DefaultStatVFS is the StatVFSer used when a consumer just wants real
+// filesystem-stat semantics without writing their own. Setting
+// Handlers.StatVFS = DefaultStatVFS{} is enough on its own: RequestServer
+// advertises statvfs@openssh.com/fstatvfs@openssh.com to the client as soon
+// as Handlers.StatVFS is non-nil.
+type DefaultStatVFS struct{}
+
+func (DefaultStatVFS) StatVFS(r *Request) (*StatVFS, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(r.Filepath, &stat); err != nil {
+		return nil, err
+	}
+	return &StatVFS{
+		Bsize:   uint64(stat.Bsize),
+		Frsize:  uint64(stat.Frsize),
+		Blocks:  stat.Blocks,
+		Bfree:   stat.Bfree,
+		Bavail:  stat.Bavail,
+		Files:   stat.Files,
+		Ffree:   stat.Ffree,
+		Favail:  stat.Ffree,
+		Fsid:    uint64(stat.Fsid.X__val[0]),
+		Flag:    statvfsFlags(int64(stat.Flags)),
+		Namemax: uint64(stat.Namelen),
+	}, nil
+}
+
+// statvfsFlags remaps the ST_* bits Linux's statfs(2) reports in f_flags
+// onto the statvfs@openssh.com wire flags explicitly, rather than passing
+// the raw word through.
+func statvfsFlags(raw int64) uint64 {
+	// ST_RDONLY and ST_NOSUID from <sys/statvfs.h>; the syscall package
+	// doesn't export them.
+	const (
+		stRdonly = 0x1
+		stNosuid = 0x2
+	)
+	var flag uint64
+	if raw&stRdonly != 0 {
+		flag |= sshStatVFSFlagReadonly
+	}
+	if raw&stNosuid != 0 {
+		flag |= sshStatVFSFlagNoSuid
+	}
+	return flag
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package sftp
+
+import "syscall"
+
+// DefaultStatVFS has no syscall.Statfs equivalent on Windows, so it always
+// reports the extension as unsupported.
+type DefaultStatVFS struct{}
+
+func (DefaultStatVFS) StatVFS(r *Request) (*StatVFS, error) {
+	return nil, syscall.EOPNOTSUPP
+}
@@ -0,0 +1,45 @@
+package sftp
+
+// StatVFSer is an optional Handlers field that answers the
+// statvfs@openssh.com and fstatvfs@openssh.com extended requests.
+type StatVFSer interface {
+	StatVFS(r *Request) (*StatVFS, error)
+}
+
+// statvfs@openssh.com flag bits, per OpenSSH's PROTOCOL file. These are
+// protocol-defined, not an OS's raw mount-flag word, so each platform's
+// StatVFSer has to remap its own syscall flags onto them explicitly.
+const (
+	sshStatVFSFlagReadonly = 0x1
+	sshStatVFSFlagNoSuid   = 0x2
+)
+
+// StatVFS mirrors OpenSSH's statvfs@openssh.com reply body: eleven uint64
+// fields, in wire order, describing the filesystem a path lives on.
+type StatVFS struct {
+	Bsize   uint64
+	Frsize  uint64
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Favail  uint64
+	Fsid    uint64
+	Flag    uint64
+	Namemax uint64
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler. The result is the reply
+// body only; callers wrap it in a sshFxpExtendedReplyPacket alongside the
+// request id.
+func (st *StatVFS) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, 8*11)
+	for _, v := range []uint64{
+		st.Bsize, st.Frsize, st.Blocks, st.Bfree, st.Bavail,
+		st.Files, st.Ffree, st.Favail, st.Fsid, st.Flag, st.Namemax,
+	} {
+		buf = marshalUint64(buf, v)
+	}
+	return buf, nil
+}